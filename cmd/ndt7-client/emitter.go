@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/m-lab/ndt7-clients/go/ndt7-client/spec"
+)
+
+// emitter is implemented by types that report the progress of a ndt7
+// subtest to the user.
+type emitter interface {
+	onStarting(subtest string)
+	onConnected(subtest, fqdn string)
+	onDownloadEvent(m *spec.Measurement)
+	onUploadEvent(m *spec.Measurement)
+	onError(subtest string, err error)
+	onComplete(subtest string)
+}
+
+// goodputMbps returns the goodput, in Mbit/s, implied by m, and
+// whether m carries enough information (a client-origin AppInfo) to
+// compute it at all.
+func goodputMbps(m *spec.Measurement) (float64, bool) {
+	if m.AppInfo == nil || m.Origin != spec.OriginClient || m.AppInfo.ElapsedTime <= 0 {
+		return 0, false
+	}
+	elapsed := time.Duration(m.AppInfo.ElapsedTime) * time.Microsecond
+	return float64(m.AppInfo.NumBytes) * 8 / elapsed.Seconds() / 1e6, true
+}
+
+// interactive is an emitter that prints human readable progress to the
+// standard output.
+type interactive struct{}
+
+func (interactive) onStarting(subtest string) {
+	fmt.Printf("Starting %s\n", subtest)
+}
+
+func (interactive) onConnected(subtest, fqdn string) {
+	fmt.Printf("Connected to %s for %s\n", fqdn, subtest)
+}
+
+func (interactive) emitEvent(m *spec.Measurement) {
+	if mbps, ok := goodputMbps(m); ok {
+		fmt.Printf("\rAvg. speed  : %7.2f Mbit/s", mbps)
+	}
+}
+
+func (i interactive) onDownloadEvent(m *spec.Measurement) {
+	i.emitEvent(m)
+}
+
+func (i interactive) onUploadEvent(m *spec.Measurement) {
+	i.emitEvent(m)
+}
+
+func (interactive) onError(subtest string, err error) {
+	fmt.Printf("Failed to run %s: %s\n", subtest, err)
+}
+
+func (interactive) onComplete(subtest string) {
+	fmt.Printf("\n%s: complete\n", subtest)
+}
+
+// batch is an emitter that prints one JSON event per line to the
+// standard output, suitable for machine parsing.
+type batch struct{}
+
+type batchEvent struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+func (batch) emit(key string, value interface{}) {
+	data, err := json.Marshal(batchEvent{Key: key, Value: value})
+	if err != nil {
+		log.WithError(err).Warn("json.Marshal failed")
+		return
+	}
+	fmt.Println(string(data))
+}
+
+func (b batch) onStarting(subtest string) {
+	b.emit("status.measurement_start", map[string]string{"subtest": subtest})
+}
+
+func (b batch) onConnected(subtest, fqdn string) {
+	b.emit("status.measurement_begin", map[string]string{
+		"server":  fqdn,
+		"subtest": subtest,
+	})
+}
+
+func (b batch) onDownloadEvent(m *spec.Measurement) {
+	b.emit("measurement", m)
+}
+
+func (b batch) onUploadEvent(m *spec.Measurement) {
+	b.emit("measurement", m)
+}
+
+func (b batch) onError(subtest string, err error) {
+	b.emit("failure.measurement", map[string]string{
+		"failure": err.Error(),
+		"subtest": subtest,
+	})
+}
+
+func (b batch) onComplete(subtest string) {
+	b.emit("status.measurement_done", map[string]string{"subtest": subtest})
+}
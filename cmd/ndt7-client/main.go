@@ -3,6 +3,7 @@
 // Usage:
 //
 //    ndt7-client [-batch] [-hostname <hostname>] [-timeout <seconds>]
+//      [-duration <seconds>] [-scheme <wss|ws>]
 //
 // ndt7-client performs a ndt7 nettest.
 //
@@ -18,14 +19,23 @@
 // running ndt7 test should timeout. The default is a large enough
 // value that should be suitable for common conditions.
 //
+// The `-duration <seconds>` flag, when nonzero, asks the server to end
+// each subtest early after the given number of seconds and also
+// enforces that deadline locally, which is useful for running quicker,
+// lower-fidelity tests. The default is zero, meaning the server decides
+// how long each subtest runs.
+//
+// The `-scheme <wss|ws>` flag selects whether to connect over TLS
+// (`wss`, the default) or in plaintext (`ws`), the latter being useful
+// when testing against a local ndt-server.
+//
 // Additionally, passing any unrecognized flag, such as `-help`, will
 // cause ndt7-client to print a brief help message.
 //
 // Event emitted in batch mode
 //
 // This section describes the events emitted in batch mode. The code
-// will always emit a single event per line. In some cases we have
-// wrapped long event lines, below, to simplify reading.
+// will always emit a single event per line.
 //
 // When the download subtest starts, this event is emitted:
 //
@@ -53,8 +63,8 @@
 //   {"key": "measurement", "value": <value>}
 //
 // where `<value>` is a serialized spec.Measurement struct. Note that
-// the minimal `<value>` MUST contain a field name `"subtest"` with
-// value equal either to `"download"` or `"upload"`.
+// the minimal `<value>` MUST contain a field named `"Test"` with value
+// equal either to `"download"` or `"upload"`.
 //
 // Finally, this event is always emitted at the end of the subtest:
 //
@@ -73,13 +83,12 @@
 package main
 
 import (
-	"context"
 	"flag"
 	"os"
 	"time"
 
-	"github.com/m-lab/ndt7-client-go"
-	"github.com/m-lab/ndt7-client-go/spec"
+	"github.com/m-lab/ndt7-clients/go/ndt7-client/client"
+	"github.com/m-lab/ndt7-clients/go/ndt7-client/spec"
 )
 
 var flagBatch = flag.Bool("batch", false, "emit JSON events on stdout")
@@ -90,8 +99,25 @@ var flagTimeout = flag.Int64(
 	"timeout", 45, "seconds after which the ndt7 test is aborted",
 )
 
+var flagDuration = flag.Int64(
+	"duration", 0,
+	"optional seconds after which each subtest should early-exit (0: let the server decide)",
+)
+
+var flagScheme = flag.String(
+	"scheme", "wss", "URL scheme to use: wss (the default) or ws for plaintext",
+)
+
+// clientName and clientVersion identify this binary to the server and
+// to the Locate service, so M-Lab operators can attribute traffic.
+// clientVersion is overridden at build time with -ldflags
+// "-X main.clientVersion=...".
+const clientName = "ndt7-client-go-cmd"
+
+var clientVersion = "dev"
+
 func runSubtest(
-	client *ndt7.Client, emitter emitter, subtest string,
+	cl *client.Client, emitter emitter, subtest string,
 	start func() (<-chan spec.Measurement, error),
 	emitEvent func(m *spec.Measurement),
 ) (code int) {
@@ -108,7 +134,7 @@ func runSubtest(
 		code = 2
 		return
 	}
-	emitter.onConnected(subtest, client.FQDN)
+	emitter.onConnected(subtest, cl.FQDN)
 	for ev := range ch {
 		emitEvent(&ev)
 	}
@@ -116,39 +142,35 @@ func runSubtest(
 	return
 }
 
-func download(client *ndt7.Client, emitter emitter) int {
+func download(cl *client.Client, emitter emitter) int {
 	return runSubtest(
-		client, emitter, "download", client.StartDownload,
-		emitter.onDownloadEvent,
+		cl, emitter, "download", cl.Download, emitter.onDownloadEvent,
 	)
 }
 
-func upload(client *ndt7.Client, emitter emitter) int {
+func upload(cl *client.Client, emitter emitter) int {
 	return runSubtest(
-		client, emitter, "upload", client.StartUpload,
-		emitter.onUploadEvent,
+		cl, emitter, "upload", cl.Upload, emitter.onUploadEvent,
 	)
 }
 
-func realmain(timeoutSec int64, hostname string, batchmode bool) int {
-	timeout := time.Duration(timeoutSec) * time.Second
-	ctx, cancel := context.WithTimeout(
-		context.Background(), time.Duration(timeout),
-	)
-	defer cancel()
-	client := ndt7.NewClient(ctx)
-	client.FQDN = hostname
+func realmain(timeoutSec, durationSec int64, hostname, scheme string, batchmode bool) int {
+	cl := client.NewClient(clientName, clientVersion)
+	cl.Hostname = hostname
+	cl.Duration = time.Duration(durationSec) * time.Second
+	cl.Timeout = time.Duration(timeoutSec) * time.Second
+	cl.Scheme = scheme
 	var emitter emitter = interactive{}
 	if batchmode {
 		emitter = batch{}
 	}
-	return download(client, emitter) + upload(client, emitter)
+	return download(cl, emitter) + upload(cl, emitter)
 }
 
 var osExit = os.Exit
 
 func main() {
 	flag.Parse()
-	rv := realmain(*flagTimeout, *flagHostname, *flagBatch)
+	rv := realmain(*flagTimeout, *flagDuration, *flagHostname, *flagScheme, *flagBatch)
 	osExit(rv)
 }
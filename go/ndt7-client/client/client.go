@@ -2,27 +2,98 @@
 package client
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/apex/log"
 	"github.com/gorilla/websocket"
+	"github.com/m-lab/ndt7-clients/go/ndt7-client/locate"
 	"github.com/m-lab/ndt7-clients/go/ndt7-client/protocol"
+	"github.com/m-lab/ndt7-clients/go/ndt7-client/spec"
 )
 
 // Client is a ndt7 client.
 type Client struct {
-	// Hostname is the hostname to use
+	// ClientName is the name this client identifies itself with, sent
+	// as part of the User-Agent header and as the "client_name" query
+	// parameter.
+	ClientName string
+
+	// ClientVersion is the version this client identifies itself with,
+	// sent as part of the User-Agent header and as the
+	// "client_version" query parameter.
+	ClientVersion string
+
+	// Hostname is the hostname to use. When empty, Download and Upload
+	// discover a set of candidate servers using the Locate service and
+	// try them in order until one succeeds.
 	Hostname string
 
-	// Port is the port to use
+	// Port is the port to use when no Locate-provided URL is available
+	// for an access point, i.e. when Hostname overrides discovery.
 	Port string
 
 	// Insecure controls whether to skip TLS verification
 	Insecure bool
+
+	// FQDN is the fully qualified domain name of the server that was
+	// actually used to run the last subtest. It is populated by
+	// Download and Upload once a connection succeeds.
+	FQDN string
+
+	// Duration bounds how long a subtest should run. When zero, the
+	// subtest runs until the server ends it. When positive, it is
+	// forwarded to the server as the "duration" query parameter (an
+	// early-exit hint) and also enforced locally by the client.
+	Duration time.Duration
+
+	// Timeout is a safety net bounding how long service discovery and
+	// each subtest's transfer phase, once connected, may individually
+	// run before being aborted, in case either hangs (e.g. a stalled
+	// Locate query or a peer that stops sending). It does not bound the
+	// dial and handshake, which are bounded only by the Dialer's
+	// HandshakeTimeout. When zero, no such bound is enforced beyond
+	// whatever Duration already implies.
+	Timeout time.Duration
+
+	// Scheme is the URL scheme to use when connecting, either "wss"
+	// (the default) or "ws", the latter being useful for running
+	// against a local, plaintext ndt-server during development.
+	Scheme string
+
+	// Dialer, when set, overrides the default websocket.Dialer used to
+	// establish the subtest connection, letting callers bind to a
+	// specific interface, route through a proxy, or otherwise
+	// customize how the underlying connection is established. Insecure
+	// still applies on top of it. The default 3-second HandshakeTimeout
+	// is only applied when Dialer is nil; a caller-supplied Dialer's own
+	// HandshakeTimeout, including a zero value, is honored as-is.
+	Dialer *websocket.Dialer
+}
+
+// NewClient creates a new Client that identifies itself to the server
+// and to the Locate service as clientName/clientVersion.
+func NewClient(clientName, clientVersion string) *Client {
+	return &Client{
+		ClientName:    clientName,
+		ClientVersion: clientVersion,
+	}
+}
+
+// scheme returns the URL scheme to use, defaulting to "wss".
+func (cl *Client) scheme() string {
+	if cl.Scheme != "" {
+		return cl.Scheme
+	}
+	return "wss"
 }
 
 // dial allows to inject failures when running tests
@@ -30,20 +101,67 @@ var dial = func(dialer websocket.Dialer, URL string, header http.Header) (*webso
 	return dialer.Dial(URL, header)
 }
 
-// dial creates and configures the websocket connection
-func (cl Client) dial(urlpath string) (*websocket.Conn, error) {
+// locateNearest allows to inject failures when running tests
+var locateNearest = locate.Nearest
+
+// accessPointKey returns the key the Locate service uses in
+// Server.URLs to identify the access point reached by urlpath under
+// cl.scheme(), e.g. "wss:///ndt/v7/download".
+func (cl *Client) accessPointKey(urlpath string) string {
+	return cl.scheme() + ":///" + strings.TrimPrefix(urlpath, "/")
+}
+
+// dialTo creates and configures the websocket connection to the given
+// candidate server. When the Locate service handed back a URL for this
+// access point, that URL is used, keeping its own query parameters,
+// since it may carry an access token the server requires; otherwise
+// the URL is built from the server's Machine and cl.Port, which is
+// always the case when cl.Hostname overrides discovery. An empty
+// cl.Port leaves the scheme's default port in effect. Either way, the
+// duration and client identification query parameters are then added.
+func (cl *Client) dialTo(server locate.Server, urlpath string) (*websocket.Conn, error) {
 	var URL url.URL
-	URL.Scheme = "wss"
-	URL.Path = urlpath
-	URL.Host = cl.Hostname + ":" + cl.Port
+	if raw, ok := server.URLs[cl.accessPointKey(urlpath)]; ok {
+		parsed, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		URL = *parsed
+	} else {
+		URL.Scheme = cl.scheme()
+		URL.Path = urlpath
+		URL.Host = server.Machine
+		if cl.Port != "" {
+			URL.Host += ":" + cl.Port
+		}
+	}
+	q := URL.Query()
+	if cl.Duration > 0 {
+		q.Set("duration", strconv.FormatInt(cl.Duration.Milliseconds(), 10))
+	}
+	if cl.ClientName != "" {
+		q.Set("client_name", cl.ClientName)
+	}
+	if cl.ClientVersion != "" {
+		q.Set("client_version", cl.ClientVersion)
+	}
+	URL.RawQuery = q.Encode()
 	var dialer websocket.Dialer
+	if cl.Dialer != nil {
+		dialer = *cl.Dialer
+	}
 	if cl.Insecure {
 		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 	log.Debugf("Connecting to: %s", URL.String())
 	headers := http.Header{}
 	headers.Add("Sec-WebSocket-Protocol", "net.measurementlab.ndt.v7")
-	dialer.HandshakeTimeout = 3 * time.Second
+	if cl.ClientName != "" {
+		headers.Add("User-Agent", fmt.Sprintf("%s/%s", cl.ClientName, cl.ClientVersion))
+	}
+	if cl.Dialer == nil {
+		dialer.HandshakeTimeout = 3 * time.Second
+	}
 	conn, _, err := dial(dialer, URL.String(), headers)
 	if err != nil {
 		return nil, err
@@ -54,6 +172,50 @@ func (cl Client) dial(urlpath string) (*websocket.Conn, error) {
 	return conn, nil
 }
 
+// candidates returns the ordered list of candidate servers to try. When
+// Hostname is set explicitly, it is the only candidate, and it carries
+// no URLs, so dialTo builds its endpoint URL manually. Otherwise
+// candidates queries the Locate service for a set of nearby servers,
+// in the order it recommends trying them.
+func (cl *Client) candidates() ([]locate.Server, error) {
+	if cl.Hostname != "" {
+		return []locate.Server{{Machine: cl.Hostname}}, nil
+	}
+	clientName := cl.ClientName
+	if clientName == "" {
+		clientName = "ndt7-clients"
+	}
+	ctx := context.Background()
+	if cl.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cl.Timeout)
+		defer cancel()
+	}
+	return locateNearest(ctx, clientName)
+}
+
+// dialAny tries each candidate server in order, returning the first
+// successful connection. It records the FQDN of the server that
+// succeeded in cl.FQDN.
+func (cl *Client) dialAny(urlpath string) (*websocket.Conn, error) {
+	servers, err := cl.candidates()
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, server := range servers {
+		conn, err := cl.dialTo(server, urlpath)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to connect to %s, trying next candidate", server.Machine)
+			lastErr = err
+			continue
+		}
+		cl.FQDN = server.Machine
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
 // closeandwarn will warn if closing a closer causes a failure
 func closeandwarn(closer io.Closer, message string) {
 	err := closer.Close()
@@ -62,27 +224,82 @@ func closeandwarn(closer io.Closer, message string) {
 	}
 }
 
-// Download runs a ndt7 download test.
-func (cl Client) Download() error {
-	conn, err := cl.dial("/ndt/v7/download")
+// deadline returns a context bound by the tighter of cl.Duration and
+// cl.Timeout, if either is set, and the corresponding cancel function.
+// Callers must always invoke cancel.
+func (cl *Client) deadline() (context.Context, context.CancelFunc) {
+	d := cl.Duration
+	if cl.Timeout > 0 && (d <= 0 || cl.Timeout < d) {
+		d = cl.Timeout
+	}
+	if d <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), d)
+}
+
+// Download runs a ndt7 download test, returning a channel of
+// measurements as they become available. The channel is closed once
+// the subtest is over; any error encountered while running it is
+// logged but not delivered through the channel, matching the ndt7
+// spec's advice to treat a subtest as best-effort once it has started.
+func (cl *Client) Download() (<-chan spec.Measurement, error) {
+	conn, err := cl.dialAny("/ndt/v7/download")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer closeandwarn(conn, "Ignored error when closing connection")
-	return protocol.Counterflow(conn, protocol.Measurer(protocol.Reader(conn)))
+	ctx, cancel := cl.deadline()
+	events := make(chan spec.Measurement)
+	go func() {
+		defer cancel()
+		defer close(events)
+		defer closeandwarn(conn, "Ignored error when closing connection")
+		input := protocol.Measurer(protocol.Reader(ctx, conn))
+		if err := protocol.Counterflow(ctx, conn, input, "download", events); err != nil {
+			log.WithError(err).Warn("download subtest ended with an error")
+		}
+	}()
+	return events, nil
 }
 
-// Upload runs a ndt7 upload test.
-func (cl Client) Upload() error {
-	conn, err := cl.dial("/ndt/v7/upload")
+// Upload runs a ndt7 upload test, returning a channel of measurements
+// as they become available. The channel is closed once the subtest is
+// over; any error encountered while running it is logged but not
+// delivered through the channel.
+func (cl *Client) Upload() (<-chan spec.Measurement, error) {
+	conn, err := cl.dialAny("/ndt/v7/upload")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer closeandwarn(conn, "Ignored error when closing connection")
+	deadlineCtx, cancelDeadline := cl.deadline()
+	ctx, cancel := context.WithCancel(deadlineCtx)
+	events := make(chan spec.Measurement)
 	go func() {
-		for range protocol.Reader(conn) {
-			// discard
+		defer cancelDeadline()
+		defer cancel()
+		defer close(events)
+		defer closeandwarn(conn, "Ignored error when closing connection")
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range protocol.Reader(ctx, conn) {
+				// discard; the server has nothing to say during upload
+			}
+		}()
+		errc := protocol.Writer(ctx, conn, "upload", events)
+		err := <-errc
+		// Stop the reader goroutine as soon as the writer is done, then
+		// wait for it, and for the writer's own goroutines, to exit before
+		// returning, so that Upload never leaves a goroutine running
+		// behind the caller's back.
+		cancel()
+		for range errc {
+		}
+		wg.Wait()
+		if err != nil {
+			log.WithError(err).Warn("upload subtest ended with an error")
 		}
 	}()
-	return <-protocol.Writer(conn)
+	return events, nil
 }
@@ -0,0 +1,235 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/goleak"
+
+	"github.com/m-lab/ndt7-clients/go/ndt7-client/locate"
+)
+
+// newTestServer starts an in-process ndt7 server that accepts a single
+// WebSocket connection on any path, sends a handful of measurements (or
+// just reads them, for the upload subtest) and then closes the
+// connection, so Download and Upload can be exercised end to end
+// without reaching the network.
+func newTestServer(t *testing.T, send bool) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Logf("upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		if send {
+			for i := 0; i < 3; i++ {
+				if err := conn.WriteMessage(websocket.TextMessage, []byte("{}")); err != nil {
+					return
+				}
+			}
+		} else {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}
+	})
+	return httptest.NewServer(mux)
+}
+
+// newStreamingTestServer starts an in-process ndt7 server that, unlike
+// newTestServer, keeps sending measurements every interval until the
+// connection errors out from under it (e.g. because the client hit its
+// local deadline and stopped reading). This is what a real ndt7 server
+// looks like from the download side, and is what forces the client's
+// local-deadline shutdown path to run while frames are still in flight.
+func newStreamingTestServer(t *testing.T, interval time.Duration) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Logf("upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		for {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("{}")); err != nil {
+				return
+			}
+			time.Sleep(interval)
+		}
+	})
+	return httptest.NewServer(mux)
+}
+
+// clientFor returns a Client configured to dial srv.
+func clientFor(srv *httptest.Server) *Client {
+	cl := NewClient("ndt7-client-go-test", "0.0.0")
+	cl.Scheme = "ws"
+	hostport := strings.TrimPrefix(srv.URL, "http://")
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		panic(err)
+	}
+	cl.Hostname = host
+	cl.Port = port
+	return cl
+}
+
+func TestDownloadNoGoroutineLeak(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	srv := newTestServer(t, true)
+	defer srv.Close()
+	cl := clientFor(srv)
+	cl.Duration = 200 * time.Millisecond
+	ch, err := cl.Download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+	}
+}
+
+// TestDownloadNoGoroutineLeakOnLocalDeadline exercises the path where
+// the server is still streaming measurements when the client's own
+// Duration elapses, so Download must shut down via ctx.Done() while a
+// Reader-to-Counterflow send may be in flight, rather than via the
+// server closing the connection first.
+func TestDownloadNoGoroutineLeakOnLocalDeadline(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	srv := newStreamingTestServer(t, 5*time.Millisecond)
+	defer srv.Close()
+	cl := clientFor(srv)
+	cl.Duration = 150 * time.Millisecond
+	ch, err := cl.Download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+	}
+}
+
+// TestDownloadNoGoroutineLeakOnEarlyStop exercises the path where the
+// caller itself stops ranging over the channel returned by Download
+// before it closes, which is an ordinary thing for a library consumer
+// to do (e.g. to enforce its own cancellation). The internal pipeline
+// must still unwind once Duration elapses rather than leak goroutines
+// blocked on a send nobody is receiving from anymore.
+func TestDownloadNoGoroutineLeakOnEarlyStop(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	srv := newStreamingTestServer(t, 5*time.Millisecond)
+	defer srv.Close()
+	cl := clientFor(srv)
+	cl.Duration = 150 * time.Millisecond
+	ch, err := cl.Download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+}
+
+// TestDialAnyFailoverUsesLocateURL exercises two things: dialAny
+// falling over to the next
+// Locate candidate when the first one can't be reached, and dialTo
+// using the URL the Locate service handed back for an access point
+// (rather than reconstructing one from Machine and Port, which would
+// silently drop an access token the URL carries).
+func TestDialAnyFailoverUsesLocateURL(t *testing.T) {
+	srv := newTestServer(t, true)
+	defer srv.Close()
+	goodURL := "ws://" + strings.TrimPrefix(srv.URL, "http://") + "/ndt/v7/download?access_token=good-token"
+
+	var dialedURL string
+	origDial := dial
+	dial = func(dialer websocket.Dialer, URL string, header http.Header) (*websocket.Conn, *http.Response, error) {
+		dialedURL = URL
+		return origDial(dialer, URL, header)
+	}
+	defer func() { dial = origDial }()
+
+	origLocate := locateNearest
+	defer func() { locateNearest = origLocate }()
+	locateNearest = func(ctx context.Context, clientName string) ([]locate.Server, error) {
+		return []locate.Server{
+			{Machine: "unreachable.test", URLs: map[string]string{
+				"ws:///ndt/v7/download": "ws://127.0.0.1:1/ndt/v7/download",
+			}},
+			{Machine: "good.test", URLs: map[string]string{
+				"ws:///ndt/v7/download": goodURL,
+			}},
+		}, nil
+	}
+
+	cl := NewClient("ndt7-client-go-test", "0.0.0")
+	cl.Scheme = "ws"
+	ch, err := cl.Download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+	}
+	if cl.FQDN != "good.test" {
+		t.Fatalf("expected failover to good.test, got %q", cl.FQDN)
+	}
+	if !strings.Contains(dialedURL, "access_token=good-token") {
+		t.Fatalf("expected the Locate-provided URL, access token included, to be used, got %q", dialedURL)
+	}
+}
+
+// TestDialToHonorsCustomDialerHandshakeTimeout guards against dialTo
+// unconditionally overwriting a caller-supplied Dialer's
+// HandshakeTimeout, which would defeat use cases like a SOCKS-proxy
+// dialer that legitimately needs longer than the 3-second default to
+// establish a path.
+func TestDialToHonorsCustomDialerHandshakeTimeout(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	srv := newTestServer(t, true)
+	defer srv.Close()
+
+	origDial := dial
+	var gotTimeout time.Duration
+	dial = func(dialer websocket.Dialer, URL string, header http.Header) (*websocket.Conn, *http.Response, error) {
+		gotTimeout = dialer.HandshakeTimeout
+		return origDial(dialer, URL, header)
+	}
+	defer func() { dial = origDial }()
+
+	cl := clientFor(srv)
+	cl.Duration = 200 * time.Millisecond
+	cl.Dialer = &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+
+	ch, err := cl.Download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+	}
+	if gotTimeout != 10*time.Second {
+		t.Fatalf("expected the custom HandshakeTimeout to be honored, got %v", gotTimeout)
+	}
+}
+
+func TestUploadNoGoroutineLeak(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	srv := newTestServer(t, false)
+	defer srv.Close()
+	cl := clientFor(srv)
+	cl.Duration = 200 * time.Millisecond
+	ch, err := cl.Upload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+	}
+}
@@ -0,0 +1,65 @@
+// Package locate discovers candidate ndt7 servers using Measurement
+// Lab's Locate v2 API.
+package locate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// BaseURL is the default Locate v2 API endpoint used to discover ndt7
+// servers.
+const BaseURL = "https://locate.measurementlab.net/v2/nearest/ndt/ndt7"
+
+// Server describes a single candidate ndt7 server returned by the
+// Locate service.
+type Server struct {
+	// Machine is the FQDN of the candidate server.
+	Machine string `json:"machine"`
+
+	// URLs maps "<scheme>:///<path>" access point descriptors to the
+	// fully qualified URLs clients should use to reach them.
+	URLs map[string]string `json:"urls"`
+}
+
+type result struct {
+	Results []Server `json:"results"`
+	Error   *struct {
+		Title string `json:"title"`
+	} `json:"error"`
+}
+
+// Nearest queries the Locate service for the servers nearest to the
+// caller, which identifies itself with clientName. It returns the
+// candidate servers in the order the Locate service recommends trying
+// them.
+func Nearest(ctx context.Context, clientName string) ([]Server, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, BaseURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Set("client_name", clientName)
+	req.URL.RawQuery = q.Encode()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("locate: unexpected status code: %d", resp.StatusCode)
+	}
+	var r result
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	if r.Error != nil {
+		return nil, fmt.Errorf("locate: %s", r.Error.Title)
+	}
+	if len(r.Results) == 0 {
+		return nil, fmt.Errorf("locate: no available servers")
+	}
+	return r.Results, nil
+}
@@ -0,0 +1,273 @@
+// Package protocol implements the ndt7 measurement pipeline: reading
+// WebSocket messages off the wire, decoding them into spec.Measurement
+// values, and feeding the client's own measurements back to the
+// server.
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/ndt7-clients/go/ndt7-client/sink"
+	"github.com/m-lab/ndt7-clients/go/ndt7-client/spec"
+)
+
+// measureInterval is how often the client reports its own measurement,
+// either back to the server (while receiving) or to the server
+// directly (while sending).
+const measureInterval = time.Second
+
+// closeGracePeriod is how long we wait for a close control message to
+// reach the peer before giving up on a graceful shutdown.
+const closeGracePeriod = time.Second
+
+// MeasureResult is a single spec.Measurement produced by the pipeline,
+// alongside any error encountered while producing it. Once Err is set,
+// no further values should be expected from the channel.
+type MeasureResult struct {
+	Measurement spec.Measurement
+	Err         error
+}
+
+// byteCounter tracks the application-level bytes transferred and the
+// time elapsed since a subtest began, used to fill in AppInfo for the
+// client-origin measurements this package synthesizes.
+type byteCounter struct {
+	start time.Time
+	n     int64
+}
+
+func newByteCounter() *byteCounter {
+	return &byteCounter{start: time.Now()}
+}
+
+func (c *byteCounter) add(n int) {
+	atomic.AddInt64(&c.n, int64(n))
+}
+
+func (c *byteCounter) appInfo() spec.AppInfo {
+	return spec.AppInfo{
+		NumBytes:    atomic.LoadInt64(&c.n),
+		ElapsedTime: time.Since(c.start).Microseconds(),
+	}
+}
+
+// sendClose sends a normal-closure control message to conn, used when a
+// subtest ends because its deadline elapsed rather than because the
+// peer closed the connection.
+func sendClose(conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	deadline := time.Now().Add(closeGracePeriod)
+	if err := conn.WriteControl(websocket.CloseMessage, msg, deadline); err != nil {
+		log.WithError(err).Warn("Failed to send close message")
+	}
+}
+
+type frame struct {
+	kind int
+	data []byte
+	err  error
+}
+
+// Reader reads messages from conn until an error occurs, the
+// connection is closed, or ctx is done. Every server-sent text message
+// is decoded into a server-origin spec.Measurement; meanwhile, Reader
+// also emits a client-origin spec.Measurement carrying the locally
+// observed AppInfo counters once every measureInterval. When ctx
+// carries a deadline, Reader arranges for conn to stop blocking once
+// that deadline elapses. Reader never writes to conn itself, including
+// the closing control message: that is the responsibility of whichever
+// of Counterflow or Writer is driving the same conn, so that exactly
+// one goroutine ends up racing to close it.
+func Reader(ctx context.Context, conn *websocket.Conn) <-chan MeasureResult {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	raw := make(chan frame)
+	// done lets the consumer goroutine below tell the blocking reader
+	// goroutine to give up on a pending send once the consumer has
+	// stopped listening (e.g. because ctx was cancelled), so that a
+	// ReadMessage call that only returns once conn is eventually closed
+	// does not leak a goroutine stuck forever on raw <- frame{...}.
+	done := make(chan struct{})
+	go func() {
+		for {
+			kind, mdata, err := conn.ReadMessage()
+			select {
+			case raw <- frame{kind: kind, data: mdata, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	output := make(chan MeasureResult)
+	go func() {
+		defer close(output)
+		defer close(done)
+		counter := newByteCounter()
+		ticker := time.NewTicker(measureInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case fr, ok := <-raw:
+				if !ok {
+					return
+				}
+				if fr.err != nil {
+					// The consumer on the other end of output (Counterflow
+					// or a discarding range loop) may itself be exiting on
+					// the very same ctx.Done(), in which case nothing will
+					// ever read this send again; give up on it rather than
+					// leak this goroutine forever.
+					select {
+					case output <- MeasureResult{Err: fr.err}:
+					case <-ctx.Done():
+					}
+					return
+				}
+				counter.add(len(fr.data))
+				if fr.kind != websocket.TextMessage {
+					continue
+				}
+				var m spec.Measurement
+				if err := json.Unmarshal(fr.data, &m); err != nil {
+					select {
+					case output <- MeasureResult{Err: err}:
+					case <-ctx.Done():
+					}
+					return
+				}
+				m.Origin = spec.OriginServer
+				select {
+				case output <- MeasureResult{Measurement: m}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ticker.C:
+				ai := counter.appInfo()
+				select {
+				case output <- MeasureResult{Measurement: spec.Measurement{
+					AppInfo: &ai,
+					Origin:  spec.OriginClient,
+				}}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return output
+}
+
+// Measurer is currently a passthrough: it forwards every result read
+// by Reader. It is the seam where additional client-side processing of
+// the measurement stream (e.g. computing derived statistics) can be
+// inserted.
+func Measurer(input <-chan MeasureResult) <-chan MeasureResult {
+	return input
+}
+
+// Counterflow drains input, forwarding every measurement to events,
+// while also periodically sending this client's own measurement back
+// to the server, as required while the client is the receiver. It
+// returns the first error encountered, or nil once input closes
+// cleanly or ctx is done.
+func Counterflow(ctx context.Context, conn *websocket.Conn, input <-chan MeasureResult, subtest string, events chan<- spec.Measurement) error {
+	ticker := time.NewTicker(measureInterval)
+	defer ticker.Stop()
+	// own is the latest client-origin measurement seen on input,
+	// serialized for sending back to the server.
+	own := []byte("{}")
+	for {
+		select {
+		case <-ctx.Done():
+			sendClose(conn)
+			return nil
+		case mr, ok := <-input:
+			if !ok {
+				return nil
+			}
+			if mr.Err != nil {
+				return mr.Err
+			}
+			m := mr.Measurement
+			if m.Origin == spec.OriginClient {
+				if data, err := json.Marshal(m); err == nil {
+					own = data
+				}
+			}
+			m.Test = subtest
+			// The caller is free to stop ranging over events before ctx
+			// is done (e.g. to enforce its own cancellation); without this
+			// escape we'd block here forever and leak Reader's goroutines
+			// and the underlying connection along with us.
+			select {
+			case events <- m:
+			case <-ctx.Done():
+				sendClose(conn)
+				return nil
+			}
+		case <-ticker.C:
+			if err := conn.WriteMessage(websocket.TextMessage, own); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Writer periodically generates this client's own measurement,
+// forwarding it to events and writing it to conn, as required while
+// the client is the sender. It stops once ctx is done and returns a
+// channel carrying the first fatal error encountered.
+func Writer(ctx context.Context, conn *websocket.Conn, subtest string, events chan<- spec.Measurement) <-chan error {
+	input := make(chan sink.MeasureResult)
+	go func() {
+		defer close(input)
+		counter := newByteCounter()
+		ticker := time.NewTicker(measureInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				sendClose(conn)
+				return
+			case <-ticker.C:
+				ai := counter.appInfo()
+				m := spec.Measurement{AppInfo: &ai, Origin: spec.OriginClient}
+				data, err := json.Marshal(m)
+				if err != nil {
+					return
+				}
+				counter.add(len(data))
+				ev := m
+				ev.Test = subtest
+				// Same escape as Counterflow: the caller may stop ranging
+				// over events before ctx is done, and we must not block
+				// here forever if it does.
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					sendClose(conn)
+					return
+				}
+				select {
+				case input <- sink.MeasureResult{Measurement: data}:
+				case <-ctx.Done():
+					sendClose(conn)
+					return
+				}
+			}
+		}
+	}()
+	return sink.Writer(conn, input)
+}
@@ -0,0 +1,13 @@
+package sink
+
+// MeasureResult bundles a single client-side measurement payload
+// destined for the server with any error encountered while producing
+// it. Once Err is set, no further values should be expected from the
+// channel carrying these results.
+type MeasureResult struct {
+	// Measurement is the JSON-serialized measurement to send upstream.
+	Measurement []byte
+
+	// Err is set when producing the measurement failed.
+	Err error
+}
@@ -0,0 +1,79 @@
+// Package spec defines the ndt7 subtest measurement schema exchanged
+// between client and server, as described by the ndt7 protocol spec.
+package spec
+
+// Origin identifies which endpoint produced a Measurement.
+type Origin string
+
+const (
+	// OriginClient marks a Measurement produced locally by the client.
+	OriginClient = Origin("client")
+
+	// OriginServer marks a Measurement received from the server.
+	OriginServer = Origin("server")
+)
+
+// AppInfo contains the application-level transfer counters included in
+// a Measurement.
+type AppInfo struct {
+	// NumBytes is the number of bytes transferred at application level
+	// since the start of the subtest.
+	NumBytes int64
+
+	// ElapsedTime is the time elapsed since the start of the subtest,
+	// measured in microseconds.
+	ElapsedTime int64
+}
+
+// BBRInfo contains the subset of the BBR congestion-control
+// statistics that ndt7 reports, when available.
+type BBRInfo struct {
+	// Bandwidth is BBR's current estimate of available bandwidth, in
+	// bytes per second.
+	Bandwidth int64
+
+	// RTT is BBR's current estimate of the round-trip time, in
+	// seconds.
+	RTT float64
+}
+
+// TCPInfo contains the subset of Linux's struct tcp_info that ndt7
+// reports, when available.
+type TCPInfo struct {
+	// RTT is the smoothed round-trip time, in microseconds.
+	RTT int64
+
+	// RTTVar is the round-trip time variance, in microseconds.
+	RTTVar int64
+
+	// BytesAcked is the number of bytes acknowledged by the peer.
+	BytesAcked int64
+}
+
+// ConnectionInfo describes the underlying TCP connection used for the
+// subtest.
+type ConnectionInfo struct {
+	// Client is the client endpoint, as "<address>:<port>".
+	Client string
+
+	// Server is the server endpoint, as "<address>:<port>".
+	Server string
+
+	// UUID is the connection identifier the server uses to correlate
+	// the measurement with its own archival data.
+	UUID string `json:",omitempty"`
+}
+
+// Measurement is a single measurement exchanged between client and
+// server during a subtest. Origin indicates which endpoint produced
+// it: a client-origin Measurement fills in AppInfo, while a
+// server-origin Measurement fills in whichever of BBRInfo, TCPInfo and
+// ConnectionInfo the server was able to collect.
+type Measurement struct {
+	AppInfo        *AppInfo        `json:",omitempty"`
+	BBRInfo        *BBRInfo        `json:",omitempty"`
+	ConnectionInfo *ConnectionInfo `json:",omitempty"`
+	TCPInfo        *TCPInfo        `json:",omitempty"`
+	Origin         Origin          `json:",omitempty"`
+	Test           string          `json:",omitempty"`
+}